@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	log "github.com/sirupsen/logrus"
+)
+
+// AzureContentStore stores blob content as block blobs in an Azure Storage
+// container, keyed the same way as the S3 driver.
+type AzureContentStore struct {
+	container    azblob.ContainerURL
+	unsafeDelete bool
+}
+
+// NewAzureContentStore builds a ContentStore backed by the Azure Blob
+// container named in params.Container, under the storage account
+// params.Account. It is registered under the "Azure" driver name.
+func NewAzureContentStore(params DriverParameters) (ContentStore, error) {
+	if params.Account == "" || params.Container == "" {
+		return nil, fmt.Errorf("Azure driver requires Account and Container")
+	}
+
+	log.WithFields(log.Fields{
+		"account":   params.Account,
+		"container": params.Container,
+	}).Info("Creating Azure client for content store")
+
+	credential, err := azblob.NewSharedKeyCredential(params.Account, Config.AzureAccountKey)
+	if err != nil {
+		return nil, err
+	}
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+
+	u, err := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net/%s", params.Account, params.Container))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &AzureContentStore{
+		container:    azblob.NewContainerURL(*u, pipeline),
+		unsafeDelete: params.UnsafeDelete,
+	}
+	startTrashSweeper("azure-content-store-trash", func(ctx context.Context) error {
+		return azureEmptyTrash(ctx, s.container, blobTrashLifetime())
+	})
+	return s, nil
+}
+
+func (s *AzureContentStore) key(meta *MetaObject) string {
+	return fmt.Sprintf("%s/%s", blobPrefix, transformKey(meta.Oid))
+}
+
+func (s *AzureContentStore) blobURL(meta *MetaObject) azblob.BlockBlobURL {
+	return s.container.NewBlockBlobURL(s.key(meta))
+}
+
+// rawDelete removes the blob immediately, bypassing trash. Put's own
+// mismatch cleanup below uses this directly instead of Delete: the blob was
+// never a committed, possibly-concurrently-read object, so there's nothing
+// for trash to protect against.
+func (s *AzureContentStore) rawDelete(ctx context.Context, meta *MetaObject) error {
+	_, err := s.blobURL(meta).Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	return err
+}
+
+// Get downloads the blob starting at fromByte and returns its body stream.
+func (s *AzureContentStore) Get(ctx context.Context, meta *MetaObject, fromByte int64) (io.ReadCloser, error) {
+	log.WithField("object", meta.Oid).Info("Get")
+	resp, err := s.blobURL(meta).Download(ctx, fromByte, azblob.CountToEnd, azblob.BlobAccessConditions{}, false)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body(azblob.RetryReaderOptions{}), nil
+}
+
+// countingReader wraps an io.Reader and tracks how many bytes have passed
+// through it, so Put can verify the final size once UploadStreamToBlockBlob
+// has consumed the whole body.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Put streams r to Azure via UploadStreamToBlockBlob, computing its sha256
+// digest and length on the fly, so a multi-gigabyte LFS asset is never held
+// in memory all at once. As with the S3 driver, the digest can only be
+// verified once the whole body has been read, so a mismatch is only
+// detectable after the blob has already landed; Put cleans that up with
+// rawDelete rather than leaving a blob under the wrong key behind.
+func (s *AzureContentStore) Put(ctx context.Context, meta *MetaObject, r io.Reader) error {
+	digest := sha256.New()
+	cr := &countingReader{r: io.TeeReader(r, digest)}
+
+	bufferSize := Config.AzureUploadBufferSize
+	if bufferSize <= 0 {
+		bufferSize = 4 * 1024 * 1024
+	}
+	maxBuffers := Config.AzureUploadMaxBuffers
+	if maxBuffers <= 0 {
+		maxBuffers = 4
+	}
+
+	log.WithField("object", meta.Oid).Info("Put")
+	_, err := azblob.UploadStreamToBlockBlob(ctx, cr, s.blobURL(meta), azblob.UploadStreamToBlockBlobOptions{
+		BufferSize: bufferSize,
+		MaxBuffers: maxBuffers,
+	})
+	if err != nil {
+		return err
+	}
+
+	if cr.n != meta.Size {
+		log.WithField("object", meta.Oid).Warn("Put size mismatch, deleting uploaded blob")
+		if delErr := s.rawDelete(ctx, meta); delErr != nil {
+			log.WithField("object", meta.Oid).WithError(delErr).Error("failed to delete blob after size mismatch")
+		}
+		return errSizeMismatch
+	}
+
+	shaStr := hex.EncodeToString(digest.Sum(nil))
+	if shaStr != meta.Oid {
+		log.WithField("object", meta.Oid).Warn("Put hash mismatch, deleting uploaded blob")
+		if delErr := s.rawDelete(ctx, meta); delErr != nil {
+			log.WithField("object", meta.Oid).WithError(delErr).Error("failed to delete blob after hash mismatch")
+		}
+		return errHashMismatch
+	}
+
+	return nil
+}
+
+// Exists returns true if the blob's properties can be fetched.
+func (s *AzureContentStore) Exists(ctx context.Context, meta *MetaObject) bool {
+	_, err := s.blobURL(meta).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	return err == nil
+}
+
+// Delete moves the blob under trash/ with a deletion timestamp instead of
+// removing it outright, mirroring S3ContentStore.Delete: this guards
+// against a racing Put resurrecting the blob while a concurrent Delete is
+// removing it. EmptyTrash (run periodically by the background sweeper
+// started in NewAzureContentStore) removes it for good once
+// Config.BlobTrashLifetime has elapsed.
+func (s *AzureContentStore) Delete(ctx context.Context, meta *MetaObject) error {
+	log.WithField("object", meta.Oid).Info("Delete")
+	return azureTrash(ctx, s.container, s.key(meta))
+}
+
+// PurgeBlob permanently removes a blob immediately, bypassing trash. It
+// only works on volumes created with DriverParameters.UnsafeDelete; on
+// every other volume it refuses and returns errS3TrashDisabled, since an
+// immediate delete is exactly what the trash workflow exists to avoid.
+func (s *AzureContentStore) PurgeBlob(ctx context.Context, oid string) error {
+	if !s.unsafeDelete {
+		return errS3TrashDisabled
+	}
+	log.WithField("object", oid).Info("Purge")
+	return s.rawDelete(ctx, &MetaObject{Oid: oid})
+}
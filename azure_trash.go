@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	log "github.com/sirupsen/logrus"
+)
+
+// azureDeletedAtKey is the blob metadata key azureTrash stamps on a trashed
+// copy, mirroring s3Trash's Deleted-At object metadata. Azure lowercases
+// metadata keys, so azureEmptyTrash reads it back lowercase too.
+const azureDeletedAtKey = "deletedat"
+
+// azureTrash copies key to trash/<key> with a deletedat metadata timestamp
+// and then removes the original, instead of deleting it outright. As with
+// s3Trash, the delete is unconditional, so a racing Put that recreates key
+// after the copy but before the delete is removed as well; the trash copy,
+// holding the same content-addressed bytes, stays until azureEmptyTrash
+// purges it.
+func azureTrash(ctx context.Context, container azblob.ContainerURL, key string) error {
+	trashKey := fmt.Sprintf("%s/%s", trashPrefix, key)
+	log.WithFields(log.Fields{"object": key, "trash": trashKey}).Info("Trash")
+
+	src := container.NewBlockBlobURL(key)
+	dst := container.NewBlockBlobURL(trashKey)
+
+	metadata := azblob.Metadata{azureDeletedAtKey: time.Now().UTC().Format(time.RFC3339)}
+	resp, err := dst.StartCopyFromURL(ctx, src.URL(), metadata, azblob.ModifiedAccessConditions{}, azblob.BlobAccessConditions{}, azblob.DefaultAccessTier, nil)
+	if err != nil {
+		return err
+	}
+
+	status := resp.CopyStatus()
+	for status == azblob.CopyStatusPending {
+		time.Sleep(100 * time.Millisecond)
+		props, err := dst.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+		if err != nil {
+			return err
+		}
+		status = props.CopyStatus()
+	}
+	if status != azblob.CopyStatusSuccess {
+		return fmt.Errorf("azure trash: copy of %s ended in status %q", key, status)
+	}
+
+	_, err = src.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	return err
+}
+
+// azureEmptyTrash permanently removes every blob under trash/ whose
+// deletedat metadata is older than lifetime, mirroring s3EmptyTrash. Blobs
+// without a parseable deletedat tag are left alone rather than guessed at.
+func azureEmptyTrash(ctx context.Context, container azblob.ContainerURL, lifetime time.Duration) error {
+	var firstErr error
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		resp, err := container.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
+			Prefix:  trashPrefix + "/",
+			Details: azblob.BlobListingDetails{Metadata: true},
+		})
+		if err != nil {
+			return err
+		}
+		marker = resp.NextMarker
+
+		for _, item := range resp.Segment.BlobItems {
+			deletedAt, err := time.Parse(time.RFC3339, item.Metadata[azureDeletedAtKey])
+			if err != nil || time.Since(deletedAt) < lifetime {
+				continue
+			}
+			if _, err := container.NewBlobURL(item.Name).Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{}); err != nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FederatedContentStore spreads blobs across multiple underlying volumes.
+// Each Oid hashes to a deterministic position in the volume ring; with
+// Replication == 1 (the default) that's the single volume a blob lives on,
+// and with Replication > 1 the blob is written to that many volumes in ring
+// order so any one of them can serve reads if another is unavailable.
+type FederatedContentStore struct {
+	volumes     []ContentStore
+	replication int
+}
+
+// NewFederatedContentStore builds a ContentStore that shards or replicates
+// across params.Volumes. It is registered under the "Federated" driver name.
+func NewFederatedContentStore(params DriverParameters) (ContentStore, error) {
+	if len(params.Volumes) == 0 {
+		return nil, fmt.Errorf("Federated driver requires Volumes")
+	}
+
+	replication := params.Replication
+	if replication <= 0 {
+		replication = 1
+	}
+	if replication > len(params.Volumes) {
+		return nil, fmt.Errorf("Federated Replication (%d) exceeds number of Volumes (%d)", replication, len(params.Volumes))
+	}
+
+	volumes := make([]ContentStore, len(params.Volumes))
+	for i, vp := range params.Volumes {
+		v, err := NewContentStore(vp)
+		if err != nil {
+			return nil, fmt.Errorf("federated volume %d: %s", i, err)
+		}
+		volumes[i] = v
+	}
+
+	return &FederatedContentStore{volumes: volumes, replication: replication}, nil
+}
+
+// ring returns the ordered list of volume indices a blob with the given oid
+// is stored on, starting with its primary volume.
+func (s *FederatedContentStore) ring(oid string) []int {
+	h := fnv.New32a()
+	h.Write([]byte(oid))
+	start := int(h.Sum32()) % len(s.volumes)
+
+	order := make([]int, len(s.volumes))
+	for i := range order {
+		order[i] = (start + i) % len(s.volumes)
+	}
+	return order
+}
+
+// Get tries each replica in ring order, returning the first one that has it.
+func (s *FederatedContentStore) Get(ctx context.Context, meta *MetaObject, fromByte int64) (io.ReadCloser, error) {
+	var err error
+	for _, idx := range s.ring(meta.Oid)[:s.replication] {
+		var r io.ReadCloser
+		if r, err = s.volumes[idx].Get(ctx, meta, fromByte); err == nil {
+			return r, nil
+		}
+		log.WithFields(log.Fields{"volume": idx, "oid": meta.Oid, "err": err}).Warn("federated Get failed on replica")
+	}
+	return nil, err
+}
+
+// Put writes meta's replicas to their ring volumes in order, buffering the
+// body in memory only when Replication > 1 requires reading it more than
+// once.
+func (s *FederatedContentStore) Put(ctx context.Context, meta *MetaObject, r io.Reader) error {
+	targets := s.ring(meta.Oid)[:s.replication]
+	if len(targets) == 1 {
+		return s.volumes[targets[0]].Put(ctx, meta, r)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	for _, idx := range targets {
+		if err := s.volumes[idx].Put(ctx, meta, bytes.NewReader(data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Exists returns true if any replica has the object.
+func (s *FederatedContentStore) Exists(ctx context.Context, meta *MetaObject) bool {
+	for _, idx := range s.ring(meta.Oid)[:s.replication] {
+		if s.volumes[idx].Exists(ctx, meta) {
+			return true
+		}
+	}
+	return false
+}
+
+// Delete removes the object from every replica, returning the first error
+// encountered (after still attempting the rest) so a single bad volume
+// doesn't leave the others holding an orphaned copy.
+func (s *FederatedContentStore) Delete(ctx context.Context, meta *MetaObject) error {
+	var firstErr error
+	for _, idx := range s.ring(meta.Oid)[:s.replication] {
+		if err := s.volumes[idx].Delete(ctx, meta); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// GCSContentStore stores blob content as objects in a Google Cloud Storage
+// bucket, keyed the same way as the S3 driver.
+type GCSContentStore struct {
+	bucket       *storage.BucketHandle
+	unsafeDelete bool
+}
+
+// NewGCSContentStore builds a ContentStore backed by the GCS bucket named in
+// params.Bucket. It is registered under the "GCS" driver name.
+func NewGCSContentStore(params DriverParameters) (ContentStore, error) {
+	if params.Bucket == "" {
+		return nil, fmt.Errorf("GCS driver requires Bucket")
+	}
+
+	log.WithField("bucket", params.Bucket).Info("Creating GCS client for content store")
+
+	client, err := storage.NewClient(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	s := &GCSContentStore{
+		bucket:       client.Bucket(params.Bucket),
+		unsafeDelete: params.UnsafeDelete,
+	}
+	startTrashSweeper("gcs-content-store-trash", func(ctx context.Context) error {
+		return gcsEmptyTrash(ctx, s.bucket, blobTrashLifetime())
+	})
+	return s, nil
+}
+
+func (s *GCSContentStore) key(meta *MetaObject) string {
+	return fmt.Sprintf("%s/%s", blobPrefix, transformKey(meta.Oid))
+}
+
+func (s *GCSContentStore) object(meta *MetaObject) *storage.ObjectHandle {
+	return s.bucket.Object(s.key(meta))
+}
+
+// rawDelete removes the object immediately, bypassing trash. PurgeBlob uses
+// it; Put needs no cleanup of its own, since on a mismatch it aborts the
+// write with CloseWithError before the object is committed.
+func (s *GCSContentStore) rawDelete(ctx context.Context, meta *MetaObject) error {
+	return s.object(meta).Delete(ctx)
+}
+
+// Get opens a ranged reader starting at fromByte.
+func (s *GCSContentStore) Get(ctx context.Context, meta *MetaObject, fromByte int64) (io.ReadCloser, error) {
+	log.WithField("object", meta.Oid).Info("Get")
+	return s.object(meta).NewRangeReader(ctx, fromByte, -1)
+}
+
+// Put streams r to GCS while computing its sha256 digest, aborting the
+// write if the digest or size doesn't match meta.
+func (s *GCSContentStore) Put(ctx context.Context, meta *MetaObject, r io.Reader) error {
+	w := s.object(meta).NewWriter(ctx)
+
+	digest := sha256.New()
+	written, err := io.Copy(w, io.TeeReader(r, digest))
+	if err != nil {
+		w.CloseWithError(err)
+		return err
+	}
+
+	if written != meta.Size {
+		w.CloseWithError(errSizeMismatch)
+		return errSizeMismatch
+	}
+
+	shaStr := hex.EncodeToString(digest.Sum(nil))
+	if shaStr != meta.Oid {
+		w.CloseWithError(errHashMismatch)
+		return errHashMismatch
+	}
+
+	log.WithField("object", meta.Oid).Info("Put")
+	return w.Close()
+}
+
+// Exists returns true if the object's metadata can be fetched.
+func (s *GCSContentStore) Exists(ctx context.Context, meta *MetaObject) bool {
+	_, err := s.object(meta).Attrs(ctx)
+	return err == nil
+}
+
+// Delete moves the object under trash/ with a deletion timestamp instead of
+// removing it outright, mirroring S3ContentStore.Delete: this guards
+// against a racing Put resurrecting the object while a concurrent Delete is
+// removing it. EmptyTrash (run periodically by the background sweeper
+// started in NewGCSContentStore) removes it for good once
+// Config.BlobTrashLifetime has elapsed.
+func (s *GCSContentStore) Delete(ctx context.Context, meta *MetaObject) error {
+	log.WithField("object", meta.Oid).Info("Delete")
+	return gcsTrash(ctx, s.bucket, s.key(meta))
+}
+
+// PurgeBlob permanently removes an object immediately, bypassing trash. It
+// only works on volumes created with DriverParameters.UnsafeDelete; on
+// every other volume it refuses and returns errS3TrashDisabled, since an
+// immediate delete is exactly what the trash workflow exists to avoid.
+func (s *GCSContentStore) PurgeBlob(ctx context.Context, oid string) error {
+	if !s.unsafeDelete {
+		return errS3TrashDisabled
+	}
+	log.WithField("object", oid).Info("Purge")
+	return s.rawDelete(ctx, &MetaObject{Oid: oid})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// gcsDeletedAtKey is the object metadata key gcsTrash stamps on a trashed
+// copy, mirroring s3Trash's Deleted-At object metadata.
+const gcsDeletedAtKey = "Deleted-At"
+
+// gcsTrash copies key to trash/<key> with a Deleted-At metadata timestamp
+// and then removes the original, instead of deleting it outright. As with
+// s3Trash, the delete is unconditional, so a racing Put that recreates key
+// after the copy but before the delete is removed as well; the trash copy,
+// holding the same content-addressed bytes, stays until gcsEmptyTrash
+// purges it.
+func gcsTrash(ctx context.Context, bucket *storage.BucketHandle, key string) error {
+	trashKey := fmt.Sprintf("%s/%s", trashPrefix, key)
+
+	src := bucket.Object(key)
+	dst := bucket.Object(trashKey)
+
+	copier := dst.CopierFrom(src)
+	copier.Metadata = map[string]string{gcsDeletedAtKey: time.Now().UTC().Format(time.RFC3339)}
+	if _, err := copier.Run(ctx); err != nil {
+		return err
+	}
+
+	return src.Delete(ctx)
+}
+
+// gcsEmptyTrash permanently removes every object under trash/ whose
+// Deleted-At metadata is older than lifetime, mirroring s3EmptyTrash.
+// Objects without a parseable Deleted-At tag are left alone rather than
+// guessed at.
+func gcsEmptyTrash(ctx context.Context, bucket *storage.BucketHandle, lifetime time.Duration) error {
+	var firstErr error
+	it := bucket.Objects(ctx, &storage.Query{Prefix: trashPrefix + "/"})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		deletedAt, err := time.Parse(time.RFC3339, attrs.Metadata[gcsDeletedAtKey])
+		if err != nil || time.Since(deletedAt) < lifetime {
+			continue
+		}
+		if err := bucket.Object(attrs.Name).Delete(ctx); err != nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
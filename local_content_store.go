@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LocalContentStore stores blob content as plain files under RootDir, using
+// the same transformKey directory-sharding scheme as the S3 driver's key
+// layout. It exists mainly for development and single-node deployments.
+type LocalContentStore struct {
+	rootDir string
+}
+
+// NewLocalContentStore builds a ContentStore rooted at params.RootDir. It is
+// registered under the "Local" driver name.
+func NewLocalContentStore(params DriverParameters) (ContentStore, error) {
+	if params.RootDir == "" {
+		return nil, fmt.Errorf("Local driver requires RootDir")
+	}
+	if err := os.MkdirAll(filepath.Join(params.RootDir, blobPrefix), 0750); err != nil {
+		return nil, err
+	}
+	return &LocalContentStore{rootDir: params.RootDir}, nil
+}
+
+func (s *LocalContentStore) path(meta *MetaObject) string {
+	return filepath.Join(s.rootDir, blobPrefix, transformKey(meta.Oid))
+}
+
+// Get opens the object file and seeks to fromByte.
+func (s *LocalContentStore) Get(ctx context.Context, meta *MetaObject, fromByte int64) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(meta))
+	if err != nil {
+		return nil, err
+	}
+	if fromByte > 0 {
+		if _, err := f.Seek(fromByte, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Put verifies the digest of r while streaming it to a temp file, then
+// renames the temp file into place so concurrent readers never see a
+// partially written object.
+func (s *LocalContentStore) Put(ctx context.Context, meta *MetaObject, r io.Reader) error {
+	path := s.path(meta)
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	digest := sha256.New()
+	written, err := io.Copy(tmp, io.TeeReader(r, digest))
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	if written != meta.Size {
+		return errSizeMismatch
+	}
+
+	shaStr := hex.EncodeToString(digest.Sum(nil))
+	if shaStr != meta.Oid {
+		return errHashMismatch
+	}
+
+	log.WithField("object", path).Info("Put")
+	return os.Rename(tmpPath, path)
+}
+
+// Exists returns true if the object file exists.
+func (s *LocalContentStore) Exists(ctx context.Context, meta *MetaObject) bool {
+	_, err := os.Stat(s.path(meta))
+	return err == nil
+}
+
+// Delete removes the object file. Local has no concurrent writers racing
+// over the network the way the S3 driver does, so it skips the trash
+// workflow and deletes immediately.
+func (s *LocalContentStore) Delete(ctx context.Context, meta *MetaObject) error {
+	return os.Remove(s.path(meta))
+}
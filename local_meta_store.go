@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// LocalMetaStore stores object and lock metadata as plain JSON files under
+// RootDir, one file per OID and one per repo's lock list, guarded by an
+// in-process mutex. It exists mainly for development and single-node
+// deployments; unlike S3MetaStore it has no concurrent writers racing over
+// the network to protect against, so it just takes the mutex and
+// read-modify-writes the file directly instead of going through a
+// compare-and-swap loop.
+type LocalMetaStore struct {
+	mu      sync.Mutex
+	rootDir string
+}
+
+// NewLocalMetaStore builds a MetaStore rooted at params.RootDir. It is
+// registered under the "Local" driver name.
+func NewLocalMetaStore(params DriverParameters) (MetaStore, error) {
+	if params.RootDir == "" {
+		return nil, fmt.Errorf("Local driver requires RootDir")
+	}
+	if err := os.MkdirAll(filepath.Join(params.RootDir, "objects"), 0750); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(params.RootDir, locksPrefix), 0750); err != nil {
+		return nil, err
+	}
+	return &LocalMetaStore{rootDir: params.RootDir}, nil
+}
+
+func (s *LocalMetaStore) objectPath(oid string) string {
+	return filepath.Join(s.rootDir, "objects", oid+".json")
+}
+
+func (s *LocalMetaStore) locksPath(repo string) string {
+	return filepath.Join(s.rootDir, locksPrefix, repo+".json")
+}
+
+// makeKey formats repo the same way S3MetaStore.makeKey does, so
+// AllLocks reports Lock.Path with an identical "locks/<repo>:<path>"
+// prefix regardless of which MetaStore driver is configured.
+func (s *LocalMetaStore) makeKey(prefix, repo string) string {
+	return fmt.Sprintf("%s/%s", prefix, repo)
+}
+
+// readJSON unmarshals path's contents into v, treating a missing file as
+// "leave v untouched" rather than an error.
+func readJSON(path string, v interface{}) (bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(data) == 0 {
+		return false, nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// writeJSON marshals v and writes it to a temp file before renaming it into
+// place, so a reader never sees a partially written file.
+func writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".meta-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Get retrieves the Meta information for an object given information in
+// RequestVars
+func (s *LocalMetaStore) Get(ctx context.Context, v *RequestVars) (*MetaObject, error) {
+	return s.UnsafeGet(ctx, v)
+}
+
+// UnsafeGet retrieves the Meta information for an object given information
+// in RequestVars.
+// DO NOT CHECK authentication, as it is supposed to have been done before
+func (s *LocalMetaStore) UnsafeGet(ctx context.Context, v *RequestVars) (*MetaObject, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var meta MetaObject
+	ok, err := readJSON(s.objectPath(v.Oid), &meta)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errObjectNotFound
+	}
+	return &meta, nil
+}
+
+// Put writes meta information from RequestVars to the store.
+func (s *LocalMetaStore) Put(ctx context.Context, v *RequestVars) (*MetaObject, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var existing MetaObject
+	ok, err := readJSON(s.objectPath(v.Oid), &existing)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		existing.Existing = true
+		return &existing, nil
+	}
+
+	meta := &MetaObject{Oid: v.Oid, Size: v.Size}
+	if err := writeJSON(s.objectPath(v.Oid), meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Delete removes the object's metadata file. Local has no concurrent
+// writers racing over the network the way the S3 driver does, so it skips
+// the trash workflow and deletes immediately.
+func (s *LocalMetaStore) Delete(ctx context.Context, v *RequestVars) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := os.Remove(s.objectPath(v.Oid))
+	if os.IsNotExist(err) {
+		return errObjectNotFound
+	}
+	return err
+}
+
+// AddLocks write locks to the store for the repo.
+func (s *LocalMetaStore) AddLocks(ctx context.Context, repo string, l ...Lock) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var locks []Lock
+	if _, err := readJSON(s.locksPath(repo), &locks); err != nil {
+		return err
+	}
+	locks = append(locks, l...)
+	sort.Sort(LocksByCreatedAt(locks))
+	return writeJSON(s.locksPath(repo), &locks)
+}
+
+// Locks retrieves locks for the repo from the store
+func (s *LocalMetaStore) Locks(ctx context.Context, repo string) ([]Lock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var locks []Lock
+	if _, err := readJSON(s.locksPath(repo), &locks); err != nil {
+		return locks, err
+	}
+	return locks, nil
+}
+
+// FilteredLocks return filtered locks for the repo
+func (s *LocalMetaStore) FilteredLocks(ctx context.Context, repo, path, cursor, limit string) (locks []Lock, next string, err error) {
+	locks, err = s.Locks(ctx, repo)
+	if err != nil {
+		return
+	}
+
+	if cursor != "" {
+		lastSeen := -1
+		for i, l := range locks {
+			if l.Id == cursor {
+				lastSeen = i
+				break
+			}
+		}
+
+		if lastSeen > -1 {
+			locks = locks[lastSeen:]
+		} else {
+			err = fmt.Errorf("cursor (%s) not found", cursor)
+			return
+		}
+	}
+
+	if path != "" {
+		var filtered []Lock
+		for _, l := range locks {
+			if l.Path == path {
+				filtered = append(filtered, l)
+			}
+		}
+
+		locks = filtered
+	}
+
+	if limit != "" {
+		var size int
+		size, err = strconv.Atoi(limit)
+		if err != nil || size < 0 {
+			locks = make([]Lock, 0)
+			err = fmt.Errorf("Invalid limit amount: %s", limit)
+			return
+		}
+
+		if size < len(locks) {
+			if size+1 < len(locks) {
+				next = locks[size].Id
+			}
+			locks = locks[:size]
+		}
+	}
+
+	return locks, next, nil
+}
+
+// DeleteLock removes lock for the repo by id from the store
+func (s *LocalMetaStore) DeleteLock(ctx context.Context, repo, user, id string, force bool) (*Lock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var locks []Lock
+	if _, err := readJSON(s.locksPath(repo), &locks); err != nil {
+		return nil, err
+	}
+
+	newLocks := make([]Lock, 0, len(locks))
+	var deleted *Lock
+	for _, l := range locks {
+		if l.Id == id {
+			if l.Owner.Name != user && !force {
+				return nil, errNotOwner
+			}
+			lock := l
+			deleted = &lock
+		} else if len(l.Id) > 0 {
+			newLocks = append(newLocks, l)
+		}
+	}
+	if deleted == nil {
+		return nil, nil
+	}
+
+	if err := writeJSON(s.locksPath(repo), &newLocks); err != nil {
+		return deleted, err
+	}
+	return deleted, nil
+}
+
+// Close is a no-op; LocalMetaStore holds no resources worth releasing.
+func (s *LocalMetaStore) Close() {
+}
+
+// AddUser adds user credentials to the meta store.
+func (s *LocalMetaStore) AddUser(user, pass string) error {
+	return errNotImplemeted
+}
+
+// DeleteUser removes user credentials from the meta store.
+func (s *LocalMetaStore) DeleteUser(user string) error {
+	return errNotImplemeted
+}
+
+// Users returns all MetaUsers in the meta store
+func (s *LocalMetaStore) Users() ([]*S3MetaUser, error) {
+	return nil, errNotImplemeted
+}
+
+// Objects returns all MetaObjects in the meta store
+func (s *LocalMetaStore) Objects(ctx context.Context) ([]*MetaObject, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := ioutil.ReadDir(filepath.Join(s.rootDir, "objects"))
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []*MetaObject
+	for _, f := range files {
+		var meta MetaObject
+		ok, err := readJSON(filepath.Join(s.rootDir, "objects", f.Name()), &meta)
+		if err != nil {
+			return objects, err
+		}
+		if !ok {
+			continue
+		}
+		objects = append(objects, &meta)
+	}
+	return objects, nil
+}
+
+// AllLocks return all locks in the store, lock path is prepended with repo
+func (s *LocalMetaStore) AllLocks(ctx context.Context) ([]Lock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := ioutil.ReadDir(filepath.Join(s.rootDir, locksPrefix))
+	if err != nil {
+		return nil, err
+	}
+
+	var locks []Lock
+	for _, f := range files {
+		var repoLocks []Lock
+		ok, err := readJSON(filepath.Join(s.rootDir, locksPrefix, f.Name()), &repoLocks)
+		if err != nil {
+			return locks, err
+		}
+		if !ok {
+			continue
+		}
+		repo := strings.TrimSuffix(f.Name(), ".json")
+		key := s.makeKey(locksPrefix, repo)
+		for _, l := range repoLocks {
+			l.Path = fmt.Sprintf("%s:%s", key, l.Path)
+			locks = append(locks, l)
+		}
+	}
+	return locks, nil
+}
+
+// Authenticate authorizes user with password and returns the user name
+func (s *LocalMetaStore) Authenticate(user, password string) (string, bool) {
+	return "", true
+}
@@ -100,8 +100,14 @@ func main() {
 		log.SetLevel(log.InfoLevel)
 	}
 
-	metaStore := NewS3MetaStore()
-	contentStore := NewS3ContentStore()
+	metaStore, err := NewMetaStoreFromConfig()
+	if err != nil {
+		log.WithFields(log.Fields{"fn": "main", "err": "Could not create meta store"}).Fatal(err.Error())
+	}
+	contentStore, err := NewContentStoreFromConfig()
+	if err != nil {
+		log.WithFields(log.Fields{"fn": "main", "err": "Could not create content store"}).Fatal(err.Error())
+	}
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP)
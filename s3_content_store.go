@@ -1,16 +1,18 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"sync"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -18,121 +20,406 @@ var (
 	blobPrefix = "blobs"
 )
 
+// multipartGetMinSize is the smallest object size for which Get will use the
+// concurrent part-fetcher instead of a single streamed GetObject call.
+const multipartGetMinSize = 64 * 1024 * 1024
+
 // ContentStore provides a simple file system based storage.
 type S3ContentStore struct {
-	session    *session.Session
-	service    *s3.S3
-	uploader   *s3manager.Uploader
-	downloader *s3manager.Downloader
+	bucket       string
+	params       DriverParameters
+	unsafeDelete bool
+
+	mu         sync.RWMutex
+	client     *s3.Client
+	uploader   *manager.Uploader
+	downloader *manager.Downloader
+	credentialState
 }
 
 // NewContentStore creates a ContentStore at the base directory.
 func NewS3ContentStore() *S3ContentStore {
+	store, err := NewS3ContentStoreFromParams(DriverParameters{
+		Bucket:   Config.S3Bucket,
+		Region:   Config.S3Region,
+		Endpoint: Config.S3Endpoint,
+	})
+	if err != nil {
+		log.WithField("fn", "NewS3ContentStore").Fatal(err.Error())
+	}
+	return store.(*S3ContentStore)
+}
+
+// NewS3ContentStoreFromParams builds a ContentStore backed by the S3 bucket
+// described in params. It is registered under the "S3" driver name. When
+// Config.IAMRole is set, the store's clients are backed by auto-refreshing
+// IAM credentials and a background goroutine rebuilds them shortly before
+// expiry.
+func NewS3ContentStoreFromParams(params DriverParameters) (ContentStore, error) {
 	log.WithFields(log.Fields{
-		"bucket":   Config.S3Bucket,
-		"endpoint": Config.S3Endpoint,
-		"region":   Config.S3Region,
+		"bucket":   params.Bucket,
+		"endpoint": params.Endpoint,
+		"region":   params.Region,
 	}).Info("Creating AWS session for content store")
 
-	awsLogger := log.WithField("component", "aws-sdk")
+	s := &S3ContentStore{bucket: params.Bucket, params: params, unsafeDelete: params.UnsafeDelete}
+	if err := s.refreshClients(context.Background()); err != nil {
+		return nil, err
+	}
+	if usesIAMCredentials() {
+		go s.refreshLoop()
+	}
+	startTrashSweeper("content-store-trash", s.EmptyTrash)
 
-	awsConfig := &aws.Config{
-		Region:   aws.String(Config.S3Region),
-		Endpoint: aws.String(Config.S3Endpoint),
-		Logger: aws.LoggerFunc(func(args ...interface{}) {
-			awsLogger.Info(args...)
-		}),
-		S3ForcePathStyle: aws.Bool(true),
+	return s, nil
+}
+
+// refreshClients builds a fresh config and S3 clients for s.params and
+// swaps them in atomically, so requests already in flight against the old
+// clients are unaffected.
+func (s *S3ContentStore) refreshClients(ctx context.Context) error {
+	cfg, err := newAWSConfig(ctx, s.params)
+	if err != nil {
+		return err
 	}
 
-	sess := session.Must(session.NewSession(awsConfig))
+	var state credentialState
+	if usesIAMCredentials() {
+		state, err = currentCredentialState(ctx, cfg)
+		if err != nil {
+			return err
+		}
+	}
 
-	return &S3ContentStore{
-		session:    sess,
-		service:    s3.New(sess),
-		uploader:   s3manager.NewUploader(sess),
-		downloader: s3manager.NewDownloader(sess),
+	client := newS3Client(cfg, s.params)
+	uploader := manager.NewUploader(client)
+	downloader := manager.NewDownloader(client)
+
+	s.mu.Lock()
+	s.client, s.uploader, s.downloader = client, uploader, downloader
+	s.credentialState = state
+	s.mu.Unlock()
+
+	return nil
+}
+
+// refreshLoop rebuilds s's clients shortly before its IAM credentials
+// expire, so long-running servers never serve requests with a stale token.
+func (s *S3ContentStore) refreshLoop() {
+	ticker := time.NewTicker(credentialRefreshCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.RLock()
+		needsRefresh := s.credentialState.expiresWithin(credentialExpiryBuffer)
+		s.mu.RUnlock()
+		if !needsRefresh {
+			continue
+		}
+		if err := s.refreshClients(context.Background()); err != nil {
+			log.WithField("component", "aws-sdk").WithError(err).Warn("failed to refresh content store IAM credentials")
+			continue
+		}
+		log.WithField("component", "aws-sdk").Info("Refreshed content store IAM credentials")
 	}
 }
 
+// clients returns the currently active S3 clients under a read lock.
+func (s *S3ContentStore) clients() (*s3.Client, *manager.Uploader, *manager.Downloader) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client, s.uploader, s.downloader
+}
+
 func (s *S3ContentStore) makeKey(prefix, key string) string {
 	return fmt.Sprintf("%s/%s", prefix, key)
 }
 
-// Get takes a Meta object and retreives the content from the store, returning
-// it as an io.ReaderCloser. If fromByte > 0, the reader starts from that byte
-func (s *S3ContentStore) Get(meta *MetaObject, fromByte int64) (io.Reader, error) {
+// Get takes a Meta object and retrieves the content from the store, returning
+// it as an io.ReadCloser positioned at fromByte. The object is streamed
+// straight from S3 without buffering it into memory; for large objects where
+// fromByte is 0, Get instead fans out to partFetcher so the download proceeds
+// as several concurrent range requests while keeping memory bounded to
+// S3DownloaderPartSize * S3DownloaderConcurrency. Like Put's upload, and
+// unlike the metadata calls here, Get does not bound the GetObject call with
+// connectTimeout: the
+// returned body is streamed by the caller long after Get returns, so ctx (or
+// r.Context()) and the caller's eventual Body.Close() are what should govern
+// how long the read stays open, not a connect-only timeout that would cancel
+// the stream the instant Get returns.
+func (s *S3ContentStore) Get(ctx context.Context, meta *MetaObject, fromByte int64) (io.ReadCloser, error) {
 	key := s.makeKey(blobPrefix, transformKey(meta.Oid))
 
-	buf := make([]byte, meta.Size)
+	if fromByte == 0 && meta.Size >= multipartGetMinSize {
+		log.WithFields(log.Fields{"object": key, "size": meta.Size}).Info("Get (parallel)")
+		return s.partFetcher(ctx, key, meta.Size)
+	}
+
+	client, _, _ := s.clients()
 
-	log.WithField("object", key).Info("Get")
-	numBytes, err := s.downloader.Download(
-		aws.NewWriteAtBuffer(buf),
-		&s3.GetObjectInput{
-			Bucket: aws.String(Config.S3Bucket),
-			Key:    aws.String(key),
-		})
+	input := &s3.GetObjectInput{
+		Bucket: awsv2.String(s.bucket),
+		Key:    awsv2.String(key),
+	}
+	if fromByte > 0 {
+		input.Range = awsv2.String(fmt.Sprintf("bytes=%d-", fromByte))
+	}
+
+	log.WithFields(log.Fields{"object": key, "fromByte": fromByte}).Info("Get")
+	out, err := client.GetObject(ctx, input)
 	if err != nil {
 		return nil, err
 	}
-	log.WithFields(log.Fields{
-		"bucket": Config.S3Bucket,
-		"key":    key,
-		"bytes":  numBytes,
-	}).Info("Download complete")
 
-	return bytes.NewReader(buf), nil
+	return out.Body, nil
 }
 
-// Put takes a Meta object and an io.Reader and writes the content to the store.
-func (s *S3ContentStore) Put(meta *MetaObject, r io.Reader) error {
+// partFetcher downloads an object as a series of fixed-size byte-range
+// requests, up to S3DownloaderConcurrency of them in flight at once, and
+// streams the parts in order through the returned io.ReadCloser. Memory use
+// stays bounded to roughly partSize * concurrency regardless of object size:
+// sem's slots are released by the single in-order writer goroutine below as
+// it actually consumes each part, not by the fetch goroutines as soon as
+// they finish downloading, so a slow reader can't let completed-but-unread
+// parts pile up unbounded.
+func (s *S3ContentStore) partFetcher(ctx context.Context, key string, size int64) (io.ReadCloser, error) {
+	client, _, _ := s.clients()
+
+	partSize := Config.S3DownloaderPartSize
+	if partSize <= 0 {
+		partSize = 5 * 1024 * 1024
+	}
+	concurrency := Config.S3DownloaderConcurrency
+	if concurrency <= 0 {
+		concurrency = 5
+	}
+
+	numParts := int((size + partSize - 1) / partSize)
+	parts := make([]chan []byte, numParts)
+	errs := make([]chan error, numParts)
+	start := make([]chan struct{}, numParts)
+	for i := range parts {
+		parts[i] = make(chan []byte, 1)
+		errs[i] = make(chan error, 1)
+		start[i] = make(chan struct{})
+	}
+
+	// sem slots are handed out in part order, so the part the writer is
+	// waiting on always holds one of them.
+	sem := make(chan struct{}, concurrency)
+	go func() {
+		for i := 0; i < numParts; i++ {
+			sem <- struct{}{}
+			close(start[i])
+		}
+	}()
+	for i := 0; i < numParts; i++ {
+		go func(i int) {
+			<-start[i]
+
+			start := int64(i) * partSize
+			end := start + partSize - 1
+			if end >= size {
+				end = size - 1
+			}
+
+			cctx, cancel := readTimeout(ctx)
+			defer cancel()
+
+			out, err := client.GetObject(cctx, &s3.GetObjectInput{
+				Bucket: awsv2.String(s.bucket),
+				Key:    awsv2.String(key),
+				Range:  awsv2.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+			})
+			if err != nil {
+				errs[i] <- err
+				return
+			}
+			defer out.Body.Close()
+
+			data, err := ioutil.ReadAll(out.Body)
+			if err != nil {
+				errs[i] <- err
+				return
+			}
+			parts[i] <- data
+		}(i)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		// Drain every part in order even after the first error, releasing
+		// sem as each is consumed, so a fetch goroutine blocked on sem can
+		// never leak waiting for a writer that already gave up.
+		var err error
+		for i := 0; i < numParts; i++ {
+			select {
+			case data := <-parts[i]:
+				if err == nil {
+					_, err = pw.Write(data)
+				}
+			case e := <-errs[i]:
+				if err == nil {
+					err = e
+				}
+			}
+			<-sem
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr, nil
+}
+
+// Put streams r to S3 as a multipart upload, computing its sha256 digest on
+// the fly via an io.TeeReader feeding an io.Pipe into manager.Uploader, so
+// a multi-gigabyte LFS asset is never held in memory all at once. Part size
+// and upload concurrency come from Config.S3UploaderPartSize /
+// Config.S3UploaderWriteConcurrency. Because the digest can only be known
+// once the whole body has been read, a mismatch is only detectable after
+// the object has already landed in S3; Put cleans that up with DeleteObject
+// rather than leaving an object under the wrong key behind. ctx is
+// threaded through the whole upload, so a client disconnect aborts it
+// immediately instead of running to completion unobserved.
+func (s *S3ContentStore) Put(ctx context.Context, meta *MetaObject, r io.Reader) error {
 	key := s.makeKey(blobPrefix, transformKey(meta.Oid))
+	client, uploader, _ := s.clients()
 
-	var buf bytes.Buffer
+	partSize := Config.S3UploaderPartSize
+	if partSize <= 0 {
+		partSize = 5 * 1024 * 1024
+	}
+	concurrency := Config.S3UploaderWriteConcurrency
+	if concurrency <= 0 {
+		concurrency = 5
+	}
 
 	digest := sha256.New()
-	tee := io.TeeReader(r, &buf)
+	pr, pw := io.Pipe()
 
-	written, err := io.Copy(digest, tee)
-	if err != nil {
+	// feederErr carries the feeder's own verdict on the stream it read,
+	// separately from whatever error uploader.Upload returns. Once the pipe
+	// is closed with errSizeMismatch, Upload just sees a broken pipe and
+	// wraps that in its own SDK error, so callers checking err ==
+	// errSizeMismatch need the sentinel surfaced directly rather than
+	// however the SDK happened to wrap it.
+	feederErr := make(chan error, 1)
+	go func() {
+		written, err := io.Copy(pw, io.TeeReader(r, digest))
+		if err != nil {
+			feederErr <- err
+			pw.CloseWithError(err)
+			return
+		}
+		if written != meta.Size {
+			feederErr <- errSizeMismatch
+			pw.CloseWithError(errSizeMismatch)
+			return
+		}
+		feederErr <- nil
+		pw.Close()
+	}()
+
+	log.WithField("object", key).Info("Put")
+	_, uploadErr := uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket: awsv2.String(s.bucket),
+		Key:    awsv2.String(key),
+		Body:   pr,
+	}, func(u *manager.Uploader) {
+		u.PartSize = partSize
+		u.Concurrency = concurrency
+	})
+	if uploadErr != nil {
+		// Upload may have stopped reading early; unblock the feeder.
+		pr.CloseWithError(uploadErr)
+	}
+	if err := <-feederErr; err != nil {
 		return err
 	}
-
-	if written != meta.Size {
-		return errSizeMismatch
+	if uploadErr != nil {
+		return uploadErr
 	}
 
 	shaStr := hex.EncodeToString(digest.Sum(nil))
 	if shaStr != meta.Oid {
+		log.WithField("object", key).Warn("Put hash mismatch, deleting uploaded object")
+		dctx, dcancel := connectTimeout(ctx)
+		defer dcancel()
+		if _, delErr := client.DeleteObject(dctx, &s3.DeleteObjectInput{
+			Bucket: awsv2.String(s.bucket),
+			Key:    awsv2.String(key),
+		}); delErr != nil {
+			log.WithField("object", key).WithError(delErr).Error("failed to delete object after hash mismatch")
+		}
 		return errHashMismatch
 	}
 
-	log.WithField("object", key).Info("Put")
-	_, err = s.uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(Config.S3Bucket),
-		Key:    aws.String(key),
-		Body:   &buf,
-	})
-	if err != nil {
-		return err
-	}
-
 	return nil
 }
 
 // Exists returns true if the object exists in the content store.
-func (s *S3ContentStore) Exists(meta *MetaObject) bool {
+func (s *S3ContentStore) Exists(ctx context.Context, meta *MetaObject) bool {
 	key := s.makeKey(blobPrefix, transformKey(meta.Oid))
 
+	client, _, _ := s.clients()
+
+	cctx, cancel := connectTimeout(ctx)
+	defer cancel()
+
 	log.WithField("object", key).Info("HEAD")
 	input := &s3.HeadObjectInput{
-		Bucket: aws.String(Config.S3Bucket),
-		Key:    aws.String(key),
+		Bucket: awsv2.String(s.bucket),
+		Key:    awsv2.String(key),
 	}
-	_, err := s.service.HeadObject(input)
+	_, err := client.HeadObject(cctx, input)
 	if err != nil {
 		return false
 	}
 	return true
 }
+
+// Delete moves the object under trash/ with a deletion timestamp instead of
+// removing it outright. EmptyTrash (run periodically by the background
+// sweeper started in NewS3ContentStoreFromParams) removes it for good once
+// Config.BlobTrashLifetime has elapsed. This guards against a racing PUT
+// resurrecting metadata for a blob that a concurrent Delete is removing.
+func (s *S3ContentStore) Delete(ctx context.Context, meta *MetaObject) error {
+	key := s.makeKey(blobPrefix, transformKey(meta.Oid))
+	client, _, _ := s.clients()
+	return s3Trash(ctx, client, s.bucket, key)
+}
+
+// PurgeBlob permanently removes a blob immediately, bypassing trash. It
+// only works on volumes created with DriverParameters.UnsafeDelete; on
+// every other volume it refuses and returns errS3TrashDisabled, since an
+// immediate delete is exactly what the trash workflow exists to avoid.
+func (s *S3ContentStore) PurgeBlob(ctx context.Context, oid string) error {
+	if !s.unsafeDelete {
+		return errS3TrashDisabled
+	}
+
+	key := s.makeKey(blobPrefix, transformKey(oid))
+	client, _, _ := s.clients()
+
+	cctx, cancel := connectTimeout(ctx)
+	defer cancel()
+
+	log.WithField("object", key).Info("Purge")
+	_, err := client.DeleteObject(cctx, &s3.DeleteObjectInput{
+		Bucket: awsv2.String(s.bucket),
+		Key:    awsv2.String(key),
+	})
+	return err
+}
+
+// UntrashBlob restores a blob mistakenly removed by Delete.
+func (s *S3ContentStore) UntrashBlob(ctx context.Context, oid string) error {
+	client, _, _ := s.clients()
+	return s3Untrash(ctx, client, s.bucket, s.makeKey(blobPrefix, transformKey(oid)))
+}
+
+// EmptyTrash permanently removes every trashed blob older than
+// Config.BlobTrashLifetime.
+func (s *S3ContentStore) EmptyTrash(ctx context.Context) error {
+	client, _, _ := s.clients()
+	return s3EmptyTrash(ctx, client, s.bucket, blobTrashLifetime())
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// credentialRefreshCheckInterval is how often a store's background
+// refresher wakes up to check whether its IAM credentials need rebuilding.
+const credentialRefreshCheckInterval = 30 * time.Second
+
+// credentialExpiryBuffer rebuilds the S3 clients this long before the
+// current credentials actually expire, so in-flight requests never race a
+// freshly-expired token.
+const credentialExpiryBuffer = 2 * time.Minute
+
+// newAWSConfig loads an aws.Config for params. When Config.IAMRole is set
+// it's wrapped with an IAM role credential chain: Config.WebIdentityTokenFile
+// selects the IRSA / web-identity flow used on EKS (exchanging the
+// projected service-account token for role credentials via STS), otherwise
+// it falls back to the EC2 instance role read off the metadata service. With
+// neither configured, the config uses the SDK's regular default chain
+// (static keys from the environment, shared credentials file, etc).
+func newAWSConfig(ctx context.Context, params DriverParameters) (awsv2.Config, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(params.Region))
+	if err != nil {
+		return awsv2.Config{}, err
+	}
+
+	switch {
+	case Config.IAMRole != "" && Config.WebIdentityTokenFile != "":
+		stsClient := sts.NewFromConfig(cfg)
+		cfg.Credentials = awsv2.NewCredentialsCache(stscreds.NewWebIdentityRoleProvider(
+			stsClient, Config.IAMRole, stscreds.IdentityTokenFile(Config.WebIdentityTokenFile),
+			func(o *stscreds.WebIdentityRoleOptions) { o.RoleSessionName = "lfs-server-s3" },
+		))
+	case Config.IAMRole != "":
+		imdsClient := imds.New(imds.Options{})
+		cfg.Credentials = awsv2.NewCredentialsCache(ec2rolecreds.New(ec2rolecreds.Options{Client: imdsClient}))
+	}
+
+	return cfg, nil
+}
+
+// newS3Client builds the *s3.Client for params from cfg, pointing it at a
+// custom endpoint and enabling path-style addressing when params.Endpoint is
+// set (needed for S3-compatible stores like minio).
+func newS3Client(cfg awsv2.Config, params DriverParameters) *s3.Client {
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if params.Endpoint != "" {
+			o.BaseEndpoint = awsv2.String(params.Endpoint)
+			o.UsePathStyle = true
+		}
+	})
+}
+
+// usesIAMCredentials reports whether newAWSConfig will hand back
+// auto-refreshing IAM credentials rather than the SDK's default chain.
+func usesIAMCredentials() bool {
+	return Config.IAMRole != ""
+}
+
+// credentialState is the bit of bookkeeping every IAM-credentialed store
+// needs in order to refresh its clients before its credentials expire.
+type credentialState struct {
+	authToken      string
+	authExpiration time.Time
+}
+
+// expiresWithin reports whether the held credentials expire before d from
+// now, treating a zero expiration (no IAM credentials in use) as "never".
+func (c credentialState) expiresWithin(d time.Duration) bool {
+	return !c.authExpiration.IsZero() && time.Now().Add(d).After(c.authExpiration)
+}
+
+// currentCredentialState retrieves cfg's credentials once, for recording
+// the access key and expiration a store needs to decide when to refresh.
+func currentCredentialState(ctx context.Context, cfg awsv2.Config) (credentialState, error) {
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return credentialState{}, err
+	}
+	if !creds.CanExpire {
+		return credentialState{authToken: creds.AccessKeyID}, nil
+	}
+	return credentialState{authToken: creds.AccessKeyID, authExpiration: creds.Expires}, nil
+}
+
+// withTimeout derives a context bounded by d, or returns ctx unmodified
+// (with a no-op cancel) when d is unset. Callers defer the returned cancel
+// either way.
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// connectTimeout returns Config.S3ConnectTimeout for quick, metadata-only
+// calls (HEAD, LIST, DELETE, COPY).
+func connectTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, Config.S3ConnectTimeout)
+}
+
+// readTimeout returns Config.S3ReadTimeout for calls that transfer object
+// bodies (GET, PUT).
+func readTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, Config.S3ReadTimeout)
+}
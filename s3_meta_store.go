@@ -2,196 +2,552 @@ package main
 
 import (
 	"bytes"
-	"encoding/gob"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"math"
+	"math/rand"
 	"sort"
 	"strconv"
+	"sync"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
 	log "github.com/sirupsen/logrus"
 )
 
-// MetaStore implements a metadata storage. It stores user credentials and Meta information
-// for objects. The storage is handled by boltdb.
+// S3MetaStore stores object and lock metadata as JSON index objects in S3,
+// rather than one object per OID or per repo's lock list read-modify-written
+// without any concurrency control. Every mutation goes through casUpdate, a
+// compare-and-swap loop built on S3's conditional-write headers, so two
+// pushes racing to update the same index object can't silently clobber one
+// another's change the way a plain GetObject-then-PutObject would.
 type S3MetaStore struct {
-	session    *session.Session
-	service    *s3.S3
-	uploader   *s3manager.Uploader
-	downloader *s3manager.Downloader
+	params       DriverParameters
+	unsafeDelete bool
+
+	mu     sync.RWMutex
+	client *s3.Client
+	credentialState
 }
 
 var (
-	errNotImplemeted = errors.New("Method not implemented")
-	errNotOwner      = errors.New("Attempt to delete other user's lock")
+	errNotImplemeted  = errors.New("Method not implemented")
+	errNotOwner       = errors.New("Attempt to delete other user's lock")
+	errObjectNotFound = errors.New("object not found")
+)
+
+// errCASConflict is returned internally by casConditionalPut when another
+// writer updated the index object first; casUpdate retries on it rather than
+// surfacing it to the caller.
+var errCASConflict = errors.New("cas: conditional write conflict")
+
+// errCASNoop lets a casUpdate mutate callback signal "nothing to write",
+// letting casUpdate skip the PUT (and therefore the possibility of a
+// conflict) entirely.
+var errCASNoop = errors.New("cas: no update necessary")
+
+// errCASRetriesExceeded is returned when casUpdate still can't land its
+// write after casMaxRetries attempts, which only happens under very heavy
+// contention on a single index shard.
+var errCASRetriesExceeded = errors.New("cas: exceeded retry budget")
+
+// casMaxRetries bounds how many times casUpdate re-reads and retries a
+// conditional write before giving up.
+const casMaxRetries = 10
+
+// casRetryBaseDelay and casRetryMaxDelay bound the backoff casUpdate waits
+// between retries: it doubles casRetryBaseDelay on each attempt, capped at
+// casRetryMaxDelay, and jitters the result by up to 50% so concurrent
+// writers contending on the same index shard don't retry in lockstep.
+const (
+	casRetryBaseDelay = 25 * time.Millisecond
+	casRetryMaxDelay  = 1 * time.Second
 )
 
+// casRetryDelay returns the jittered backoff casUpdate should wait before
+// retrying attempt.
+func casRetryDelay(attempt int) time.Duration {
+	delay := casRetryBaseDelay << uint(attempt)
+	if delay <= 0 || delay > casRetryMaxDelay {
+		delay = casRetryMaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
 var (
-	usersPrefix   = "users"
-	objectsPrefix = "objects"
-	locksPrefix   = "locks"
+	usersPrefix       = "users"
+	objectIndexPrefix = "index/objects"
+	locksPrefix       = "locks"
 )
 
-// NewMetaStore creates a new MetaStore using the boltdb database at dbFile.
+// objectIndexEntry is one OID's record within an object index shard.
+// DeletedAt is set by Delete and cleared by UntrashObject; entries with it
+// set are treated as absent by Get/UnsafeGet/Objects until EmptyTrash
+// removes them for good once Config.BlobTrashLifetime has elapsed.
+type objectIndexEntry struct {
+	Oid       string     `json:"oid"`
+	Size      int64      `json:"size"`
+	CreatedAt time.Time  `json:"createdAt"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+}
+
+// objectIndexKey returns the index shard oid belongs to. Sharding by the
+// OID's first two hex characters spreads objects across 256 index objects
+// so no single one grows unbounded or becomes a contention hotspot.
+func objectIndexKey(oid string) string {
+	shard := oid
+	if len(shard) > 2 {
+		shard = shard[:2]
+	}
+	return fmt.Sprintf("%s/%s.json", objectIndexPrefix, shard)
+}
+
+// decodeObjectIndex parses an index shard's contents, treating an absent
+// (empty) shard as an empty index rather than an error.
+func decodeObjectIndex(data []byte) (map[string]objectIndexEntry, error) {
+	index := map[string]objectIndexEntry{}
+	if len(data) == 0 {
+		return index, nil
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// NewS3MetaStore creates a MetaStore backed by the S3 bucket described in
+// the legacy flat Config.S3* fields.
 func NewS3MetaStore() *S3MetaStore {
+	store, err := NewS3MetaStoreFromParams(DriverParameters{
+		Bucket:       Config.S3Bucket,
+		Region:       Config.S3Region,
+		Endpoint:     Config.S3Endpoint,
+		UnsafeDelete: Config.UnsafeDelete,
+	})
+	if err != nil {
+		log.WithField("fn", "NewS3MetaStore").Fatal(err.Error())
+	}
+	return store.(*S3MetaStore)
+}
+
+// NewS3MetaStoreFromParams builds a MetaStore backed by the S3 bucket
+// described in params. It is registered under the "S3" driver name.
+func NewS3MetaStoreFromParams(params DriverParameters) (MetaStore, error) {
 	log.WithFields(log.Fields{
-		"bucket":   Config.S3Bucket,
-		"endpoint": Config.S3Endpoint,
-		"region":   Config.S3Region,
+		"bucket":   params.Bucket,
+		"endpoint": params.Endpoint,
+		"region":   params.Region,
 	}).Info("Creating AWS session for meta store")
 
-	awsLogger := log.WithField("component", "aws-sdk")
+	s := &S3MetaStore{
+		params:       params,
+		unsafeDelete: params.UnsafeDelete,
+	}
+	if err := s.refreshClients(context.Background()); err != nil {
+		return nil, err
+	}
 
-	awsConfig := &aws.Config{
-		Region:   aws.String(Config.S3Region),
-		Endpoint: aws.String(Config.S3Endpoint),
-		Logger: aws.LoggerFunc(func(args ...interface{}) {
-			awsLogger.Info(args...)
-		}),
-		S3ForcePathStyle: aws.Bool(true),
+	if !Config.S3SkipCASCheck {
+		if err := detectConditionalWriteSupport(context.Background(), s.clients(), params.Bucket); err != nil {
+			return nil, err
+		}
+	}
+
+	if usesIAMCredentials() {
+		go s.refreshLoop()
+	}
+	startTrashSweeper("meta-store-trash", s.EmptyTrash)
+
+	return s, nil
+}
+
+// errConditionalWriteUnsupported is returned by detectConditionalWriteSupport
+// when the target endpoint doesn't honor PutObject's IfMatch/IfNoneMatch
+// conditional headers. Every metadata write goes through casUpdate's
+// compare-and-swap loop, so on such an endpoint every write would either
+// silently race or exhaust casMaxRetries; surfacing this at startup is far
+// better than a metadata store that appears to work until the first
+// concurrent push corrupts an index shard.
+var errConditionalWriteUnsupported = errors.New("s3 meta store: endpoint does not appear to support conditional PutObject (If-Match/If-None-Match); set Config.S3SkipCASCheck to bypass this check if you're certain it does")
+
+// casProbeKey is the throwaway object detectConditionalWriteSupport uses to
+// test the endpoint's conditional-write support.
+const casProbeKey = "index/.cas-probe"
+
+// detectConditionalWriteSupport verifies that the endpoint behind client
+// honors PutObject's IfNoneMatch header before any real metadata write is
+// trusted to it. A first conditional put to a throwaway key should succeed
+// (the key doesn't exist yet); a second with the same IfNoneMatch: "*"
+// should fail with a precondition error (the key now exists). An endpoint
+// that lets the second put through anyway silently ignores the condition,
+// which would make casConditionalPut — and therefore every metadata write —
+// unsafe. Not every S3-compatible store (the whole reason DriverParameters
+// has an Endpoint) implements conditional writes, so this is checked once
+// at startup rather than discovered the hard way under a racing push.
+func detectConditionalWriteSupport(ctx context.Context, client *s3.Client, bucket string) error {
+	defer func() {
+		cctx, cancel := connectTimeout(ctx)
+		defer cancel()
+		client.DeleteObject(cctx, &s3.DeleteObjectInput{
+			Bucket: awsv2.String(bucket),
+			Key:    awsv2.String(casProbeKey),
+		})
+	}()
+
+	put := func() error {
+		cctx, cancel := connectTimeout(ctx)
+		defer cancel()
+		_, err := client.PutObject(cctx, &s3.PutObjectInput{
+			Bucket:      awsv2.String(bucket),
+			Key:         awsv2.String(casProbeKey),
+			Body:        bytes.NewReader([]byte("{}")),
+			IfNoneMatch: awsv2.String("*"),
+		})
+		return err
+	}
+
+	if err := put(); err != nil {
+		return fmt.Errorf("conditional write probe: %w", err)
+	}
+	if err := put(); err == nil {
+		return errConditionalWriteUnsupported
+	} else if !isPreconditionFailed(err) {
+		return fmt.Errorf("conditional write probe: %w", err)
+	}
+	return nil
+}
+
+// refreshClients builds a fresh config and S3 client for s.params and swaps
+// it in atomically, so requests already in flight against the old client
+// are unaffected.
+func (s *S3MetaStore) refreshClients(ctx context.Context) error {
+	cfg, err := newAWSConfig(ctx, s.params)
+	if err != nil {
+		return err
+	}
+
+	var state credentialState
+	if usesIAMCredentials() {
+		state, err = currentCredentialState(ctx, cfg)
+		if err != nil {
+			return err
+		}
 	}
 
-	sess := session.Must(session.NewSession(awsConfig))
+	client := newS3Client(cfg, s.params)
 
-	return &S3MetaStore{
-		session:    sess,
-		service:    s3.New(sess),
-		uploader:   s3manager.NewUploader(sess),
-		downloader: s3manager.NewDownloader(sess),
+	s.mu.Lock()
+	s.client = client
+	s.credentialState = state
+	s.mu.Unlock()
+
+	return nil
+}
+
+// refreshLoop rebuilds s's client shortly before its IAM credentials expire,
+// so long-running servers never serve requests with a stale token.
+func (s *S3MetaStore) refreshLoop() {
+	ticker := time.NewTicker(credentialRefreshCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.RLock()
+		needsRefresh := s.credentialState.expiresWithin(credentialExpiryBuffer)
+		s.mu.RUnlock()
+		if !needsRefresh {
+			continue
+		}
+		if err := s.refreshClients(context.Background()); err != nil {
+			log.WithField("component", "aws-sdk").WithError(err).Warn("failed to refresh meta store IAM credentials")
+			continue
+		}
+		log.WithField("component", "aws-sdk").Info("Refreshed meta store IAM credentials")
 	}
 }
 
+// clients returns the currently active S3 client under a read lock.
+func (s *S3MetaStore) clients() *s3.Client {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.client
+}
+
 func (s *S3MetaStore) makeKey(prefix, key string) string {
 	return fmt.Sprintf("%s/%s", prefix, key)
 }
 
-// Get retrieves the Meta information for an object given information in
-// RequestVars
-func (s *S3MetaStore) Get(v *RequestVars) (*MetaObject, error) {
-	meta, error := s.UnsafeGet(v)
-	return meta, error
-}
+// s3GetObjectWithETag fetches key with a plain GetObject call and returns
+// its ETag alongside its body. Index objects are small JSON documents, so
+// there's no need for the multipart download manager here. A missing key is
+// not an error: it returns (nil, "", nil), which casUpdate and its callers
+// treat as an empty starting point.
+func (s *S3MetaStore) s3GetObjectWithETag(ctx context.Context, key string) ([]byte, string, error) {
+	client := s.clients()
 
-func (s *S3MetaStore) s3Get(key string) ([]byte, error) {
-	buf := make([]byte, 1024*1024*4)
+	cctx, cancel := connectTimeout(ctx)
+	defer cancel()
 
 	log.WithField("object", key).Debug("Get")
-	numBytes, err := s.downloader.Download(
-		aws.NewWriteAtBuffer(buf),
-		&s3.GetObjectInput{
-			Bucket: aws.String(Config.S3Bucket),
-			Key:    aws.String(key),
-		})
+	out, err := client.GetObject(cctx, &s3.GetObjectInput{
+		Bucket: awsv2.String(s.params.Bucket),
+		Key:    awsv2.String(key),
+	})
+	if isNoSuchKey(err) {
+		return nil, "", nil
+	}
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	log.WithFields(log.Fields{
-		"bucket": Config.S3Bucket,
-		"key":    key,
-		"bytes":  numBytes,
-	}).Debug("Download complete")
+	defer out.Body.Close()
 
-	return buf[:numBytes], nil
-}
-func (s *S3MetaStore) s3List(prefix string) ([]string, error) {
-	pageNum := 0
-	var keys []string
-	err := s.service.ListObjectsPages(&s3.ListObjectsInput{
-		Bucket: aws.String(Config.S3Bucket),
-		Prefix: aws.String(prefix),
-	}, func(p *s3.ListObjectsOutput, last bool) (shouldContinue bool) {
-		pageNum++
-		for _, obj := range p.Contents {
-			log.WithFields(log.Fields{
-				"bucket": Config.S3Bucket,
-				"object": *obj.Key,
-			}).Debug("list complete")
-			keys = append(keys, *obj.Key)
-		}
-		return true
-	})
+	data, err := ioutil.ReadAll(out.Body)
 	if err != nil {
-		return keys, err
+		return nil, "", err
 	}
 
-	return keys, nil
-
+	return data, awsv2.ToString(out.ETag), nil
 }
-func (s *S3MetaStore) s3Put(key string, data io.Reader) error {
+
+// casConditionalPut writes data to key conditioned on the index shard still
+// being at etag. An empty etag means the shard didn't exist on read, so the
+// write is conditioned on it still not existing (If-None-Match: "*") rather
+// than on any particular version. If another writer updated (or created)
+// the shard in between, S3 fails the precondition and casConditionalPut
+// returns errCASConflict for casUpdate to retry on.
+func (s *S3MetaStore) casConditionalPut(ctx context.Context, key string, data []byte, etag string) error {
+	client := s.clients()
+
+	cctx, cancel := connectTimeout(ctx)
+	defer cancel()
+
+	input := &s3.PutObjectInput{
+		Bucket: awsv2.String(s.params.Bucket),
+		Key:    awsv2.String(key),
+		Body:   bytes.NewReader(data),
+	}
+	if etag == "" {
+		input.IfNoneMatch = awsv2.String("*")
+	} else {
+		input.IfMatch = awsv2.String(etag)
+	}
+
 	log.WithField("object", key).Debug("Put")
-	_, err := s.uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(Config.S3Bucket),
-		Key:    aws.String(key),
-		Body:   data,
-	})
+	_, err := client.PutObject(cctx, input)
+	if isPreconditionFailed(err) {
+		return errCASConflict
+	}
 	return err
 }
 
-func (s *S3MetaStore) s3Delete(key string) error {
-	log.WithField("object", key).Debug("Delete")
-	_, err := s.service.DeleteObject(&s3.DeleteObjectInput{
-		Bucket: aws.String(Config.S3Bucket),
-		Key:    aws.String(key),
+// casUpdate fetches key, hands its current contents to mutate, and writes
+// mutate's result back with a conditional PUT. If mutate returns
+// errCASNoop, casUpdate skips the write and returns nil. If another writer
+// updates key between the read and the write, casUpdate re-reads and calls
+// mutate again, up to casMaxRetries times.
+func (s *S3MetaStore) casUpdate(ctx context.Context, key string, mutate func(data []byte) ([]byte, error)) error {
+	for attempt := 0; attempt < casMaxRetries; attempt++ {
+		data, etag, err := s.s3GetObjectWithETag(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		updated, err := mutate(data)
+		if err == errCASNoop {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = s.casConditionalPut(ctx, key, updated, etag)
+		if err == nil {
+			return nil
+		}
+		if err != errCASConflict {
+			return err
+		}
+
+		select {
+		case <-time.After(casRetryDelay(attempt)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return errCASRetriesExceeded
+}
+
+func (s *S3MetaStore) s3List(ctx context.Context, prefix string) ([]string, error) {
+	client := s.clients()
+
+	var keys []string
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: awsv2.String(s.params.Bucket),
+		Prefix: awsv2.String(prefix),
 	})
-	return err
+	for paginator.HasMorePages() {
+		cctx, cancel := connectTimeout(ctx)
+		page, err := paginator.NextPage(cctx)
+		cancel()
+		if err != nil {
+			return keys, err
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, *obj.Key)
+		}
+	}
+
+	return keys, nil
 }
 
 // Get retrieves the Meta information for an object given information in
 // RequestVars
-// DO NOT CHECK authentication, as it is supposed to have been done before
-func (s *S3MetaStore) UnsafeGet(v *RequestVars) (*MetaObject, error) {
-	var meta MetaObject
-
-	key := s.makeKey(objectsPrefix, v.Oid)
+func (s *S3MetaStore) Get(ctx context.Context, v *RequestVars) (*MetaObject, error) {
+	meta, error := s.UnsafeGet(ctx, v)
+	return meta, error
+}
 
-	buf, err := s.s3Get(key)
+// Get retrieves the Meta information for an object given information in
+// RequestVars
+// DO NOT CHECK authentication, as it is supposed to have been done before
+func (s *S3MetaStore) UnsafeGet(ctx context.Context, v *RequestVars) (*MetaObject, error) {
+	data, _, err := s.s3GetObjectWithETag(ctx, objectIndexKey(v.Oid))
 	if err != nil {
 		return nil, err
 	}
-	dec := gob.NewDecoder(bytes.NewBuffer(buf))
-	err = dec.Decode(&meta)
+	index, err := decodeObjectIndex(data)
 	if err != nil {
 		return nil, err
 	}
 
-	return &meta, nil
+	entry, ok := index[v.Oid]
+	if !ok || entry.DeletedAt != nil {
+		return nil, errObjectNotFound
+	}
+
+	return &MetaObject{Oid: entry.Oid, Size: entry.Size}, nil
 }
 
 // Put writes meta information from RequestVars to the store.
-func (s *S3MetaStore) Put(v *RequestVars) (*MetaObject, error) {
+func (s *S3MetaStore) Put(ctx context.Context, v *RequestVars) (*MetaObject, error) {
 	// Check if it exists first
-	if meta, err := s.Get(v); err == nil {
+	if meta, err := s.Get(ctx, v); err == nil {
 		meta.Existing = true
 		return meta, nil
 	}
 
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	meta := MetaObject{Oid: v.Oid, Size: v.Size}
-	err := enc.Encode(meta)
+	entry := objectIndexEntry{Oid: v.Oid, Size: v.Size, CreatedAt: time.Now().UTC()}
+	err := s.casUpdate(ctx, objectIndexKey(v.Oid), func(data []byte) ([]byte, error) {
+		index, err := decodeObjectIndex(data)
+		if err != nil {
+			return nil, err
+		}
+		index[v.Oid] = entry
+		return json.Marshal(index)
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	key := s.makeKey(objectsPrefix, v.Oid)
-	err = s.s3Put(key, bytes.NewReader(buf.Bytes()))
-	if err != nil {
-		return nil, err
+	return &MetaObject{Oid: v.Oid, Size: v.Size}, nil
+}
+
+// Delete marks the object's index entry as deleted instead of removing it
+// outright, so a racing Put for the same Oid can't be resurrected and then
+// purged by this Delete. EmptyTrash, run periodically by the background
+// sweeper started in NewS3MetaStoreFromParams, removes the entry for good once
+// Config.BlobTrashLifetime has elapsed.
+func (s *S3MetaStore) Delete(ctx context.Context, v *RequestVars) error {
+	now := time.Now().UTC()
+	return s.casUpdate(ctx, objectIndexKey(v.Oid), func(data []byte) ([]byte, error) {
+		index, err := decodeObjectIndex(data)
+		if err != nil {
+			return nil, err
+		}
+		entry, ok := index[v.Oid]
+		if !ok {
+			return nil, errObjectNotFound
+		}
+		entry.DeletedAt = &now
+		index[v.Oid] = entry
+		return json.Marshal(index)
+	})
+}
+
+// PurgeObject permanently removes an object's index entry immediately,
+// bypassing trash. It only works on stores created with
+// DriverParameters.UnsafeDelete set; otherwise it refuses and returns
+// errS3TrashDisabled.
+func (s *S3MetaStore) PurgeObject(ctx context.Context, oid string) error {
+	if !s.unsafeDelete {
+		return errS3TrashDisabled
 	}
+	return s.casUpdate(ctx, objectIndexKey(oid), func(data []byte) ([]byte, error) {
+		index, err := decodeObjectIndex(data)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := index[oid]; !ok {
+			return nil, errCASNoop
+		}
+		delete(index, oid)
+		return json.Marshal(index)
+	})
+}
 
-	return &meta, nil
+// UntrashObject restores metadata mistakenly removed by Delete.
+func (s *S3MetaStore) UntrashObject(ctx context.Context, oid string) error {
+	return s.casUpdate(ctx, objectIndexKey(oid), func(data []byte) ([]byte, error) {
+		index, err := decodeObjectIndex(data)
+		if err != nil {
+			return nil, err
+		}
+		entry, ok := index[oid]
+		if !ok || entry.DeletedAt == nil {
+			return nil, errCASNoop
+		}
+		entry.DeletedAt = nil
+		index[oid] = entry
+		return json.Marshal(index)
+	})
 }
 
-// Delete removes the meta information from RequestVars to the store.
-func (s *S3MetaStore) Delete(v *RequestVars) error {
-	key := s.makeKey(objectsPrefix, v.Oid)
-	return s.s3Delete(key)
+// EmptyTrash permanently removes every index entry whose DeletedAt is older
+// than Config.BlobTrashLifetime, across every object index shard.
+func (s *S3MetaStore) EmptyTrash(ctx context.Context) error {
+	keys, err := s.s3List(ctx, objectIndexPrefix)
+	if err != nil {
+		return err
+	}
+
+	lifetime := blobTrashLifetime()
+	var firstErr error
+	for _, key := range keys {
+		err := s.casUpdate(ctx, key, func(data []byte) ([]byte, error) {
+			index, err := decodeObjectIndex(data)
+			if err != nil {
+				return nil, err
+			}
+			changed := false
+			for oid, entry := range index {
+				if entry.DeletedAt != nil && time.Since(*entry.DeletedAt) >= lifetime {
+					delete(index, oid)
+					changed = true
+				}
+			}
+			if !changed {
+				return nil, errCASNoop
+			}
+			return json.Marshal(index)
+		})
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
 type LocksByCreatedAt []Lock
@@ -201,31 +557,29 @@ func (c LocksByCreatedAt) Less(i, j int) bool { return c[i].LockedAt.Before(c[j]
 func (c LocksByCreatedAt) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
 
 // AddLocks write locks to the store for the repo.
-func (s *S3MetaStore) AddLocks(repo string, l ...Lock) error {
+func (s *S3MetaStore) AddLocks(ctx context.Context, repo string, l ...Lock) error {
 	key := s.makeKey(locksPrefix, repo)
-	var locks []Lock
-	data, _ := s.s3Get(key)
-	if data != nil {
-		if err := json.Unmarshal(data, &locks); err != nil {
-			return err
+	return s.casUpdate(ctx, key, func(data []byte) ([]byte, error) {
+		var locks []Lock
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &locks); err != nil {
+				return nil, err
+			}
 		}
-	}
-	locks = append(locks, l...)
-	sort.Sort(LocksByCreatedAt(locks))
-	data, err := json.Marshal(&locks)
-	if err != nil {
-		return err
-	}
-
-	return s.s3Put(key, bytes.NewReader(data))
+		locks = append(locks, l...)
+		sort.Sort(LocksByCreatedAt(locks))
+		return json.Marshal(&locks)
+	})
 }
 
 // Locks retrieves locks for the repo from the store
-func (s *S3MetaStore) Locks(repo string) ([]Lock, error) {
-	key := s.makeKey(locksPrefix, repo)
+func (s *S3MetaStore) Locks(ctx context.Context, repo string) ([]Lock, error) {
 	var locks []Lock
-	data, _ := s.s3Get(key)
-	if data != nil {
+	data, _, err := s.s3GetObjectWithETag(ctx, s.makeKey(locksPrefix, repo))
+	if err != nil {
+		return locks, err
+	}
+	if len(data) > 0 {
 		if err := json.Unmarshal(data, &locks); err != nil {
 			return locks, err
 		}
@@ -234,8 +588,8 @@ func (s *S3MetaStore) Locks(repo string) ([]Lock, error) {
 }
 
 // FilteredLocks return filtered locks for the repo
-func (s *S3MetaStore) FilteredLocks(repo, path, cursor, limit string) (locks []Lock, next string, err error) {
-	locks, err = s.Locks(repo)
+func (s *S3MetaStore) FilteredLocks(ctx context.Context, repo, path, cursor, limit string) (locks []Lock, next string, err error) {
+	locks, err = s.Locks(ctx, repo)
 	if err != nil {
 		return
 	}
@@ -288,50 +642,42 @@ func (s *S3MetaStore) FilteredLocks(repo, path, cursor, limit string) (locks []L
 }
 
 // DeleteLock removes lock for the repo by id from the store
-func (s *S3MetaStore) DeleteLock(repo, user, id string, force bool) (*Lock, error) {
-	var deleted *Lock
-	var locks []Lock
-
+func (s *S3MetaStore) DeleteLock(ctx context.Context, repo, user, id string, force bool) (*Lock, error) {
 	key := s.makeKey(locksPrefix, repo)
+	var deleted *Lock
 
-	data, err := s.s3Get(key)
-	if err != nil {
-		return deleted, err
-	}
-	if data != nil {
-		if err := json.Unmarshal(data, &locks); err != nil {
-			return deleted, err
+	err := s.casUpdate(ctx, key, func(data []byte) ([]byte, error) {
+		var locks []Lock
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &locks); err != nil {
+				return nil, err
+			}
 		}
-	}
-	newLocks := make([]Lock, 0, len(locks))
 
-	var lock Lock
-	for _, l := range locks {
-		if l.Id == id {
-			if l.Owner.Name != user && !force {
-				return deleted, errNotOwner
+		newLocks := make([]Lock, 0, len(locks))
+		var lock Lock
+		for _, l := range locks {
+			if l.Id == id {
+				if l.Owner.Name != user && !force {
+					return nil, errNotOwner
+				}
+				lock = l
+			} else if len(l.Id) > 0 {
+				newLocks = append(newLocks, l)
 			}
-			lock = l
-		} else if len(l.Id) > 0 {
-			newLocks = append(newLocks, l)
 		}
-	}
-	if lock.Id == "" {
-		return deleted, nil
-	}
-	deleted = &lock
-
-	if len(newLocks) == 0 {
-		return deleted, s.s3Delete(key)
-	}
+		if lock.Id == "" {
+			return nil, errCASNoop
+		}
+		deleted = &lock
 
-	data, err = json.Marshal(&newLocks)
+		return json.Marshal(&newLocks)
+	})
 	if err != nil {
 		return deleted, err
 	}
-	err = s.s3Put(key, bytes.NewReader(data))
 
-	return deleted, err
+	return deleted, nil
 }
 
 // Close closes the underlying s3 manager
@@ -360,43 +706,49 @@ func (s *S3MetaStore) Users() ([]*S3MetaUser, error) {
 }
 
 // Objects returns all MetaObjects in the meta store
-func (s *S3MetaStore) Objects() ([]*MetaObject, error) {
+func (s *S3MetaStore) Objects(ctx context.Context) ([]*MetaObject, error) {
 	var objects []*MetaObject
 
-	keys, err := s.s3List(objectsPrefix)
+	keys, err := s.s3List(ctx, objectIndexPrefix)
 	if err != nil {
 		return objects, err
 	}
-	for _, k := range keys {
-		var meta MetaObject
-		data, err := s.s3Get(k)
+	for _, key := range keys {
+		data, _, err := s.s3GetObjectWithETag(ctx, key)
 		if err != nil {
 			return objects, err
 		}
-		dec := gob.NewDecoder(bytes.NewBuffer(data))
-		err = dec.Decode(&meta)
+		index, err := decodeObjectIndex(data)
 		if err != nil {
 			return objects, err
 		}
-		objects = append(objects, &meta)
+		for _, entry := range index {
+			if entry.DeletedAt != nil {
+				continue
+			}
+			objects = append(objects, &MetaObject{Oid: entry.Oid, Size: entry.Size})
+		}
 	}
-	return objects, err
+	return objects, nil
 }
 
 // AllLocks return all locks in the store, lock path is prepended with repo
-func (s *S3MetaStore) AllLocks() ([]Lock, error) {
+func (s *S3MetaStore) AllLocks(ctx context.Context) ([]Lock, error) {
 	var locks []Lock
-	keys, err := s.s3List(locksPrefix)
+	keys, err := s.s3List(ctx, locksPrefix)
 	if err != nil {
 		return locks, err
 	}
 
 	for _, k := range keys {
 		var l []Lock
-		data, err := s.s3Get(k)
+		data, _, err := s.s3GetObjectWithETag(ctx, k)
 		if err != nil {
 			return locks, err
 		}
+		if len(data) == 0 {
+			continue
+		}
 		if err := json.Unmarshal(data, &l); err != nil {
 			return locks, err
 		}
@@ -412,3 +764,33 @@ func (s *S3MetaStore) AllLocks() ([]Lock, error) {
 func (s *S3MetaStore) Authenticate(user, password string) (string, bool) {
 	return "", true
 }
+
+// isNoSuchKey reports whether err is the S3 "NoSuchKey" API error returned
+// by GetObject for a key that doesn't exist.
+func isNoSuchKey(err error) bool {
+	if err == nil {
+		return false
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode() == "NoSuchKey"
+	}
+	return false
+}
+
+// isPreconditionFailed reports whether err is the S3 API error returned for
+// a conditional write (If-Match / If-None-Match) whose precondition no
+// longer holds, meaning another writer updated the object first.
+func isPreconditionFailed(err error) bool {
+	if err == nil {
+		return false
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return true
+		}
+	}
+	return false
+}
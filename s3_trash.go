@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	log "github.com/sirupsen/logrus"
+)
+
+// trashPrefix is where s3Trash moves objects to instead of deleting them.
+const trashPrefix = "trash"
+
+// errS3TrashDisabled is returned when a caller asks for an immediate hard
+// delete on a volume whose DriverParameters.UnsafeDelete is false.
+var errS3TrashDisabled = errors.New("hard delete is disabled for this volume; set UnsafeDelete to allow it")
+
+// s3Trash renames key to trash/<key> by copying it with a Deleted-At
+// timestamp tag and then removing the original, instead of deleting it
+// outright. The delete is unconditional, so a racing PUT that recreates key
+// after the copy but before the delete is removed as well; the trash copy,
+// holding the same content-addressed bytes, stays until s3EmptyTrash purges
+// it and can be restored with s3Untrash.
+func s3Trash(ctx context.Context, client *s3.Client, bucket, key string) error {
+	trashKey := fmt.Sprintf("%s/%s", trashPrefix, key)
+	log.WithFields(log.Fields{"object": key, "trash": trashKey}).Info("Trash")
+
+	cctx, cancel := connectTimeout(ctx)
+	defer cancel()
+
+	_, err := client.CopyObject(cctx, &s3.CopyObjectInput{
+		Bucket:            awsv2.String(bucket),
+		CopySource:        awsv2.String(fmt.Sprintf("%s/%s", bucket, key)),
+		Key:               awsv2.String(trashKey),
+		Metadata:          map[string]string{"Deleted-At": time.Now().UTC().Format(time.RFC3339)},
+		MetadataDirective: "REPLACE",
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.DeleteObject(cctx, &s3.DeleteObjectInput{Bucket: awsv2.String(bucket), Key: awsv2.String(key)})
+	return err
+}
+
+// s3Untrash restores trash/<key> back to key, for operators recovering a
+// mistakenly-deleted object.
+func s3Untrash(ctx context.Context, client *s3.Client, bucket, key string) error {
+	trashKey := fmt.Sprintf("%s/%s", trashPrefix, key)
+
+	cctx, cancel := connectTimeout(ctx)
+	defer cancel()
+
+	_, err := client.CopyObject(cctx, &s3.CopyObjectInput{
+		Bucket:     awsv2.String(bucket),
+		CopySource: awsv2.String(fmt.Sprintf("%s/%s", bucket, trashKey)),
+		Key:        awsv2.String(key),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.DeleteObject(cctx, &s3.DeleteObjectInput{Bucket: awsv2.String(bucket), Key: awsv2.String(trashKey)})
+	return err
+}
+
+// s3EmptyTrash permanently removes every object under trash/ whose
+// Deleted-At tag is older than lifetime. Objects without a parseable
+// Deleted-At tag are left alone rather than guessed at.
+func s3EmptyTrash(ctx context.Context, client *s3.Client, bucket string, lifetime time.Duration) error {
+	var firstErr error
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: awsv2.String(bucket),
+		Prefix: awsv2.String(trashPrefix + "/"),
+	})
+	for paginator.HasMorePages() {
+		cctx, cancel := connectTimeout(ctx)
+		page, err := paginator.NextPage(cctx)
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		for _, obj := range page.Contents {
+			hctx, hcancel := connectTimeout(ctx)
+			head, err := client.HeadObject(hctx, &s3.HeadObjectInput{Bucket: awsv2.String(bucket), Key: obj.Key})
+			hcancel()
+			if err != nil {
+				firstErr = err
+				continue
+			}
+			// The SDK returns user metadata keys lowercased.
+			deletedAt, err := time.Parse(time.RFC3339, head.Metadata["deleted-at"])
+			if err != nil || time.Since(deletedAt) < lifetime {
+				continue
+			}
+			dctx, dcancel := connectTimeout(ctx)
+			_, err = client.DeleteObject(dctx, &s3.DeleteObjectInput{Bucket: awsv2.String(bucket), Key: obj.Key})
+			dcancel()
+			if err != nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// startTrashSweeper runs sweep every Config.BlobTrashCheckInterval (default
+// 24h), logging but not retrying failures under the given component name.
+func startTrashSweeper(component string, sweep func(ctx context.Context) error) {
+	interval := Config.BlobTrashCheckInterval
+	if interval <= 0 {
+		interval = 24 * time.Hour
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := sweep(context.Background()); err != nil {
+				log.WithField("component", component).WithError(err).Warn("failed to empty trash")
+			}
+		}
+	}()
+}
+
+// blobTrashLifetime returns Config.BlobTrashLifetime, defaulting to 14 days
+// when unset.
+func blobTrashLifetime() time.Duration {
+	if Config.BlobTrashLifetime > 0 {
+		return Config.BlobTrashLifetime
+	}
+	return 14 * 24 * time.Hour
+}
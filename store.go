@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// ContentStore is implemented by any backend capable of storing and
+// retrieving the binary content of LFS objects. S3ContentStore,
+// LocalContentStore, GCSContentStore, AzureContentStore and
+// FederatedContentStore all satisfy it. Every method takes the request's
+// context so a client disconnecting (or a per-call timeout expiring) frees
+// up the underlying connection immediately instead of running to
+// completion unobserved.
+type ContentStore interface {
+	Get(ctx context.Context, meta *MetaObject, fromByte int64) (io.ReadCloser, error)
+	Put(ctx context.Context, meta *MetaObject, r io.Reader) error
+	Exists(ctx context.Context, meta *MetaObject) bool
+	Delete(ctx context.Context, meta *MetaObject) error
+}
+
+// MetaStore is implemented by any backend capable of storing object and
+// lock metadata. S3MetaStore and LocalMetaStore both satisfy it; pulling
+// the interface out lets handlers depend on it instead of a concrete type.
+type MetaStore interface {
+	Get(ctx context.Context, v *RequestVars) (*MetaObject, error)
+	UnsafeGet(ctx context.Context, v *RequestVars) (*MetaObject, error)
+	Put(ctx context.Context, v *RequestVars) (*MetaObject, error)
+	Delete(ctx context.Context, v *RequestVars) error
+	AddLocks(ctx context.Context, repo string, l ...Lock) error
+	Locks(ctx context.Context, repo string) ([]Lock, error)
+	FilteredLocks(ctx context.Context, repo, path, cursor, limit string) ([]Lock, string, error)
+	DeleteLock(ctx context.Context, repo, user, id string, force bool) (*Lock, error)
+	AllLocks(ctx context.Context) ([]Lock, error)
+	Objects(ctx context.Context) ([]*MetaObject, error)
+	Close()
+	AddUser(user, pass string) error
+	DeleteUser(user string) error
+	Users() ([]*S3MetaUser, error)
+	Authenticate(user, password string) (string, bool)
+}
+
+// DriverParameters configures a single storage volume. Type selects which
+// registered driver builds the volume; the remaining fields are interpreted
+// by that driver and are optional outside of it. A "Federated" volume
+// ignores everything but Volumes and Replication, delegating storage to the
+// underlying volumes it lists.
+type DriverParameters struct {
+	Type        string             `json:"Type"`
+	Bucket      string             `json:"Bucket,omitempty"`
+	Region      string             `json:"Region,omitempty"`
+	Endpoint    string             `json:"Endpoint,omitempty"`
+	RootDir     string             `json:"RootDir,omitempty"`
+	Container   string             `json:"Container,omitempty"`
+	Account     string             `json:"Account,omitempty"`
+	Replication int                `json:"Replication,omitempty"`
+	Volumes     []DriverParameters `json:"Volumes,omitempty"`
+	// UnsafeDelete, when true, lets PurgeBlob / PurgeObject remove objects
+	// immediately, bypassing trash. When false (the default), those hard
+	// deletes are refused with errS3TrashDisabled. Delete itself trashes the
+	// object on drivers that support trash either way.
+	UnsafeDelete bool `json:"UnsafeDelete,omitempty"`
+}
+
+// contentStoreDrivers maps a DriverParameters.Type to its constructor. This
+// mirrors keepstore's driver["S3"] = ... registry so additional backends can
+// register themselves from an init() without touching this file.
+var contentStoreDrivers = map[string]func(DriverParameters) (ContentStore, error){}
+
+// RegisterContentStoreDriver makes a content store backend available under
+// the given DriverParameters.Type name.
+func RegisterContentStoreDriver(name string, ctor func(DriverParameters) (ContentStore, error)) {
+	contentStoreDrivers[name] = ctor
+}
+
+// NewContentStore builds the ContentStore described by params, dispatching
+// to the driver registered for params.Type.
+func NewContentStore(params DriverParameters) (ContentStore, error) {
+	ctor, ok := contentStoreDrivers[params.Type]
+	if !ok {
+		return nil, fmt.Errorf("content store: unknown driver %q", params.Type)
+	}
+	return ctor(params)
+}
+
+// metaStoreDrivers maps a DriverParameters.Type to its constructor, the same
+// way contentStoreDrivers does for ContentStore.
+var metaStoreDrivers = map[string]func(DriverParameters) (MetaStore, error){}
+
+// RegisterMetaStoreDriver makes a metadata store backend available under
+// the given DriverParameters.Type name.
+func RegisterMetaStoreDriver(name string, ctor func(DriverParameters) (MetaStore, error)) {
+	metaStoreDrivers[name] = ctor
+}
+
+// NewMetaStore builds the MetaStore described by params, dispatching to the
+// driver registered for params.Type.
+func NewMetaStore(params DriverParameters) (MetaStore, error) {
+	ctor, ok := metaStoreDrivers[params.Type]
+	if !ok {
+		return nil, fmt.Errorf("meta store: unknown driver %q", params.Type)
+	}
+	return ctor(params)
+}
+
+func init() {
+	RegisterContentStoreDriver("S3", NewS3ContentStoreFromParams)
+	RegisterContentStoreDriver("Local", NewLocalContentStore)
+	RegisterContentStoreDriver("GCS", NewGCSContentStore)
+	RegisterContentStoreDriver("Azure", NewAzureContentStore)
+	RegisterContentStoreDriver("Federated", NewFederatedContentStore)
+
+	RegisterMetaStoreDriver("S3", NewS3MetaStoreFromParams)
+	RegisterMetaStoreDriver("Local", NewLocalMetaStore)
+}
+
+// NewContentStoreFromConfig builds the ContentStore the server should serve
+// from. Operators declaring Config.Volumes get the heterogeneous, possibly
+// federated pool described there; everyone else gets the single S3 volume
+// described by the legacy flat Config.S3* fields.
+func NewContentStoreFromConfig() (ContentStore, error) {
+	if len(Config.Volumes) == 0 {
+		return NewS3ContentStoreFromParams(DriverParameters{
+			Bucket:   Config.S3Bucket,
+			Region:   Config.S3Region,
+			Endpoint: Config.S3Endpoint,
+		})
+	}
+	if len(Config.Volumes) == 1 {
+		return NewContentStore(Config.Volumes[0])
+	}
+	return NewFederatedContentStore(DriverParameters{Volumes: Config.Volumes, Replication: 1})
+}
+
+// NewMetaStoreFromConfig builds the MetaStore the server should serve from.
+// Operators declaring Config.MetaStore (by setting its Type) get whichever
+// registered metadata backend it names; everyone else gets the original
+// single S3 volume described by the legacy flat Config.S3* fields. Unlike
+// content, metadata isn't federated across Config.Volumes: it's the single
+// authoritative index of what exists across the whole store, so there's
+// only ever one metadata backend to pick.
+func NewMetaStoreFromConfig() (MetaStore, error) {
+	if Config.MetaStore.Type == "" {
+		return NewS3MetaStoreFromParams(DriverParameters{
+			Bucket:   Config.S3Bucket,
+			Region:   Config.S3Region,
+			Endpoint: Config.S3Endpoint,
+		})
+	}
+	return NewMetaStore(Config.MetaStore)
+}